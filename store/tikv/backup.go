@@ -0,0 +1,306 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/protobuf/proto"
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/store/tikv/backuppb"
+	"github.com/pingcap/tidb/store/tikv/tikvrpc"
+	"golang.org/x/net/context"
+)
+
+const backupMetaFileName = "backupmeta"
+
+// BackupStorage abstracts the sink that backup SST files and the backup
+// manifest are written to and read from. Implementations must be safe for
+// concurrent use by multiple goroutines.
+type BackupStorage interface {
+	// Create opens name for writing, truncating it if it already exists.
+	Create(name string) (io.WriteCloser, error)
+	// Open opens name for reading.
+	Open(name string) (io.ReadCloser, error)
+}
+
+// localBackupStorage stores backup files on the local filesystem rooted at base.
+type localBackupStorage struct {
+	base string
+}
+
+// NewLocalBackupStorage creates a BackupStorage backed by a local directory.
+// The directory is created if it does not already exist.
+func NewLocalBackupStorage(base string) (BackupStorage, error) {
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &localBackupStorage{base: base}, nil
+}
+
+func (s *localBackupStorage) Create(name string) (io.WriteCloser, error) {
+	p := path.Join(s.base, name)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	f, err := os.Create(p)
+	return f, errors.Trace(err)
+}
+
+func (s *localBackupStorage) Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(path.Join(s.base, name))
+	return f, errors.Trace(err)
+}
+
+// s3BackupStorage stores backup files in an S3 bucket under prefix.
+type s3BackupStorage struct {
+	bucket string
+	prefix string
+	cli    *s3.S3
+}
+
+// NewS3BackupStorage creates a BackupStorage backed by an S3 bucket.
+func NewS3BackupStorage(region, bucket, prefix string) (BackupStorage, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &s3BackupStorage{bucket: bucket, prefix: prefix, cli: s3.New(sess)}, nil
+}
+
+func (s *s3BackupStorage) Create(name string) (io.WriteCloser, error) {
+	return newS3Writer(s.cli, s.bucket, path.Join(s.prefix, name)), nil
+}
+
+func (s *s3BackupStorage) Open(name string) (io.ReadCloser, error) {
+	out, err := s.cli.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, name)),
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return out.Body, nil
+}
+
+// Backup backs up all raw key-value pairs in [startKey, endKey) to storage,
+// region by region, and returns a manifest describing the produced files.
+func (c *RawKVClient) Backup(ctx context.Context, startKey, endKey []byte, storage BackupStorage) (*backuppb.BackupMeta, error) {
+	meta := &backuppb.BackupMeta{StartKey: startKey, EndKey: endKey}
+	bo := NewBackoffer(ctx, rawkvMaxBackoff)
+	for !bytes.Equal(startKey, endKey) {
+		loc, err := c.backend.LocateKey(bo, startKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		regionEndKey := endKey
+		if len(loc.EndKey) > 0 && bytes.Compare(loc.EndKey, endKey) < 0 {
+			regionEndKey = loc.EndKey
+		}
+
+		file, err := c.backupRegion(bo, loc, startKey, regionEndKey, storage)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		meta.Files = append(meta.Files, file)
+		startKey = regionEndKey
+	}
+
+	w, err := storage.Create(backupMetaFileName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer w.Close()
+	data, err := proto.Marshal(meta)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return meta, nil
+}
+
+func (c *RawKVClient) backupRegion(bo *Backoffer, loc *KeyLocation, startKey, endKey []byte, storage BackupStorage) (*backuppb.File, error) {
+	fileName := fileNameForRegion(loc.Region.GetID(), startKey)
+	req := &tikvrpc.Request{
+		Type: tikvrpc.CmdRawBackup,
+		RawBackup: &kvrpcpb.BackupRequest{
+			StartKey: startKey,
+			EndKey:   endKey,
+			StorageBackend: &kvrpcpb.StorageBackend{
+				LocalPath: fileName,
+			},
+		},
+	}
+	for {
+		resp, err := c.backend.SendReq(bo, req, loc.Region, ReadTimeoutMedium)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		regionErr, err := resp.GetRegionError()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if regionErr != nil {
+			if err := c.backend.Backoff(bo, BoRegionMiss, errors.New(regionErr.String())); err != nil {
+				return nil, errors.Trace(err)
+			}
+			loc, err = c.backend.LocateKey(bo, startKey)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			fileName = fileNameForRegion(loc.Region.GetID(), startKey)
+			req.RawBackup.StorageBackend.LocalPath = fileName
+			continue
+		}
+		cmdResp := resp.RawBackup
+		if cmdResp == nil {
+			return nil, errors.Trace(ErrBodyMissing)
+		}
+		if cmdResp.GetError() != nil {
+			return nil, errors.New(cmdResp.GetError().String())
+		}
+
+		w, err := storage.Create(fileName)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer w.Close()
+		if _, err := w.Write(cmdResp.SstData); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		return &backuppb.File{
+			Name:     fileName,
+			StartKey: startKey,
+			EndKey:   endKey,
+			Crc64Xor: cmdResp.Crc64Xor,
+			Size_:    uint64(len(cmdResp.SstData)),
+		}, nil
+	}
+}
+
+// Restore restores the raw key-value pairs recorded in meta from storage by
+// ingesting each file's SST data directly into the region that currently
+// owns its key range.
+func (c *RawKVClient) Restore(ctx context.Context, meta *backuppb.BackupMeta, storage BackupStorage) error {
+	bo := NewBackoffer(ctx, rawkvMaxBackoff)
+	for _, file := range meta.Files {
+		r, err := storage.Open(file.Name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := c.restoreFile(bo, file, data); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// restoreFile ingests a single backed-up file's SST data in one RPC. This
+// assumes file's range still belongs to a single region, which is true
+// unless that region has split since Backup produced the file. Files carry
+// one flat SstData blob, so there is no way to re-split it across the
+// resulting sub-regions; rather than ingest the whole blob into each and
+// plant out-of-range keys, restoreFile refuses to proceed.
+func (c *RawKVClient) restoreFile(bo *Backoffer, file *backuppb.File, data []byte) error {
+	for {
+		loc, err := c.backend.LocateKey(bo, file.StartKey)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(loc.EndKey) > 0 && bytes.Compare(loc.EndKey, file.EndKey) < 0 {
+			return errors.Errorf("backup file %s (%x-%x) no longer fits in a single region (region now ends at %x); restoring a file whose region split since backup is not supported", file.Name, file.StartKey, file.EndKey, loc.EndKey)
+		}
+
+		req := &tikvrpc.Request{
+			Type: tikvrpc.CmdRawIngest,
+			RawIngest: &kvrpcpb.RawIngestRequest{
+				StartKey: file.StartKey,
+				EndKey:   file.EndKey,
+				SstData:  data,
+			},
+		}
+		resp, err := c.backend.SendReq(bo, req, loc.Region, ReadTimeoutMedium)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		regionErr, err := resp.GetRegionError()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if regionErr != nil {
+			if err := c.backend.Backoff(bo, BoRegionMiss, errors.New(regionErr.String())); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		cmdResp := resp.RawIngest
+		if cmdResp == nil {
+			return errors.Trace(ErrBodyMissing)
+		}
+		if cmdResp.GetError() != nil {
+			return errors.New(cmdResp.GetError().String())
+		}
+		return nil
+	}
+}
+
+func fileNameForRegion(regionID uint64, startKey []byte) string {
+	return path.Join("ranges", strconv.FormatUint(regionID, 10)+"-"+hex.EncodeToString(startKey)+".sst")
+}
+
+// s3Writer buffers a file in memory and uploads it as a single object on Close.
+// SST files produced per region are small enough that multipart upload is
+// unnecessary.
+type s3Writer struct {
+	cli    *s3.S3
+	bucket string
+	key    string
+	buf    bytes.Buffer
+}
+
+func newS3Writer(cli *s3.S3, bucket, key string) *s3Writer {
+	return &s3Writer{cli: cli, bucket: bucket, key: key}
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	_, err := w.cli.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(w.bucket),
+		Key:    aws.String(w.key),
+		Body:   bytes.NewReader(w.buf.Bytes()),
+	})
+	return errors.Trace(err)
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backuppb holds the wire types for RawKVClient's backup manifest.
+// There is no backup.proto to generate them from: they are hand-maintained,
+// but carry the same proto struct tags and RegisterType calls as generated
+// code so that proto.Marshal/Unmarshal work on them like they do on the
+// kvrpcpb types.
+package backuppb
+
+import proto "github.com/golang/protobuf/proto"
+
+// File describes a single SST file produced by a raw backup.
+type File struct {
+	Name     string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	StartKey []byte `protobuf:"bytes,2,opt,name=start_key,json=startKey,proto3" json:"start_key,omitempty"`
+	EndKey   []byte `protobuf:"bytes,3,opt,name=end_key,json=endKey,proto3" json:"end_key,omitempty"`
+	Crc64Xor uint64 `protobuf:"varint,4,opt,name=crc64_xor,json=crc64Xor,proto3" json:"crc64_xor,omitempty"`
+	Size_    uint64 `protobuf:"varint,5,opt,name=size,proto3" json:"size,omitempty"`
+}
+
+func (m *File) Reset()         { *m = File{} }
+func (m *File) String() string { return proto.CompactTextString(m) }
+func (*File) ProtoMessage()    {}
+
+// BackupMeta is the manifest produced by RawKVClient.Backup and consumed by
+// RawKVClient.Restore. It records the overall backed-up range plus the file
+// that was produced for each region.
+type BackupMeta struct {
+	StartKey []byte  `protobuf:"bytes,1,opt,name=start_key,json=startKey,proto3" json:"start_key,omitempty"`
+	EndKey   []byte  `protobuf:"bytes,2,opt,name=end_key,json=endKey,proto3" json:"end_key,omitempty"`
+	Files    []*File `protobuf:"bytes,3,rep,name=files" json:"files,omitempty"`
+}
+
+func (m *BackupMeta) Reset()         { *m = BackupMeta{} }
+func (m *BackupMeta) String() string { return proto.CompactTextString(m) }
+func (*BackupMeta) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*File)(nil), "backuppb.File")
+	proto.RegisterType((*BackupMeta)(nil), "backuppb.BackupMeta")
+}
@@ -16,57 +16,198 @@ package tikv
 import (
 	"bytes"
 	"context"
+	"sync"
 
 	"github.com/juju/errors"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/tidb/store/tikv/tikvrpc"
 )
 
+// defaultDeleteRangeConcurrency is the number of regions a DeleteRangeTask
+// will delete from concurrently when no concurrency has been set explicitly.
+const defaultDeleteRangeConcurrency = 4
+
+// deleteRangeSubRange is a single contiguous range owned by one region at
+// the time it was scheduled. Regions may have since split or merged, in
+// which case deleting it comes back with a RegionError and the sub-range is
+// re-located and re-split before being retried.
+type deleteRangeSubRange struct {
+	startKey []byte
+	endKey   []byte
+}
+
 // DeleteRangeTask is used to delete all keys in a range. After
 // performing DeleteRange, it keeps how many ranges it affects and
 // if the task was canceled or not.
 type DeleteRangeTask struct {
-	regions  int
-	canceled bool
-	store    Storage
-	ctx      context.Context
-	bo       *Backoffer
-	startKey []byte
-	endKey   []byte
+	backend      KVBackend
+	lockResolver *RawLockResolver
+	parentCtx    context.Context
+	ctx          context.Context
+	cancel       context.CancelFunc
+	bo           *Backoffer
+	startKey     []byte
+	endKey       []byte
+	concurrency  int
+
+	mu             sync.Mutex
+	regions        int
+	totalEstimated int
+	completed      [][2][]byte
+	canceled       bool
+}
+
+// NewDeleteRangeTask creates a DeleteRangeTask against a tikv Storage.
+// Deleting will not be performed right away.
+func NewDeleteRangeTask(ctx context.Context, store Storage, bo *Backoffer, startKey []byte, endKey []byte) *DeleteRangeTask {
+	return NewDeleteRangeTaskWithBackend(ctx, newStorageKVBackend(store), bo, startKey, endKey)
 }
 
-// NewDeleteRangeTask creates a DeleteRangeTask. Deleting will not be performed right away.
-func NewDeleteRangeTask(ctx context.Context, store Storage, bo *Backoffer, startKey []byte, endKey []byte) DeleteRangeTask {
-	return DeleteRangeTask{
-		regions:  0,
-		canceled: false,
-		store:    store,
-		ctx:      ctx,
-		bo:       bo,
-		startKey: startKey,
-		endKey:   endKey,
+// NewDeleteRangeTaskWithBackend creates a DeleteRangeTask against an
+// arbitrary KVBackend, allowing the same range-splitting and region-retry
+// logic to run against a non-TiKV backend, e.g. an in-memory mock for tests.
+func NewDeleteRangeTaskWithBackend(ctx context.Context, backend KVBackend, bo *Backoffer, startKey []byte, endKey []byte) *DeleteRangeTask {
+	childCtx, cancel := context.WithCancel(ctx)
+	return &DeleteRangeTask{
+		backend:      backend,
+		lockResolver: NewRawLockResolver(backend),
+		parentCtx:    ctx,
+		ctx:          childCtx,
+		cancel:       cancel,
+		bo:           bo,
+		startKey:     startKey,
+		endKey:       endKey,
+		concurrency:  defaultDeleteRangeConcurrency,
 	}
 }
 
-// Execute performs the delete range operation.
-func (t DeleteRangeTask) Execute() error {
-	startKey, rangeEndKey := t.startKey, t.endKey
+// SetConcurrency sets how many regions Execute will delete from at once.
+// It must be called before Execute.
+func (t *DeleteRangeTask) SetConcurrency(concurrency int) {
+	if concurrency > 0 {
+		t.concurrency = concurrency
+	}
+}
+
+// Execute performs the delete range operation. It locates the regions
+// covering [startKey, endKey) up front, then fans the per-region
+// CmdDeleteRange RPCs out across t.concurrency workers. A region that comes
+// back with a RegionError is re-located and re-split, and only the
+// still-undeleted part of it is retried. Canceling ctx stops every worker
+// before it sends its next region's RPC; an RPC that has already been sent
+// is not interrupted.
+func (t *DeleteRangeTask) Execute() error {
+	work := make(chan deleteRangeSubRange, t.concurrency)
+	errCh := make(chan error, t.concurrency)
+
+	initial, err := t.locateSubRanges(t.startKey, t.endKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	t.mu.Lock()
+	t.totalEstimated = len(initial)
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < t.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.worker(work, errCh)
+		}()
+	}
+
+	go func() {
+		defer close(work)
+		for _, sub := range initial {
+			select {
+			case work <- sub:
+			case <-t.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-t.parentCtx.Done():
+		t.mu.Lock()
+		t.canceled = true
+		t.mu.Unlock()
+	default:
+	}
+	return nil
+}
+
+// worker repeatedly pulls a sub-range off work and deletes it (deleteSubRange
+// re-drives its own retries via the Backoffer), until work is closed or ctx
+// is canceled. On the first error it reports it on errCh, cancels the task's
+// ctx so the other workers stop, and returns.
+func (t *DeleteRangeTask) worker(work <-chan deleteRangeSubRange, errCh chan<- error) {
 	for {
+		select {
+		case sub, ok := <-work:
+			if !ok {
+				return
+			}
+			if err := t.deleteSubRange(sub); err != nil {
+				errCh <- errors.Trace(err)
+				t.cancel()
+				return
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// locateSubRanges walks the regions covering [startKey, endKey) and returns
+// one sub-range per region, without issuing any delete yet.
+func (t *DeleteRangeTask) locateSubRanges(startKey, endKey []byte) ([]deleteRangeSubRange, error) {
+	var subs []deleteRangeSubRange
+	for !bytes.Equal(startKey, endKey) {
+		loc, err := t.backend.LocateKey(t.bo, startKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		regionEndKey := loc.EndKey
+		if loc.Contains(endKey) {
+			regionEndKey = endKey
+		}
+		subs = append(subs, deleteRangeSubRange{startKey: startKey, endKey: regionEndKey})
+		startKey = regionEndKey
+	}
+	return subs, nil
+}
+
+// deleteSubRange issues CmdDeleteRange for sub, re-locating and re-splitting
+// it on a RegionError so that only the part of the region's range that has
+// not yet been deleted is retried.
+func (t *DeleteRangeTask) deleteSubRange(sub deleteRangeSubRange) error {
+	startKey := sub.startKey
+	first := true
+	for !bytes.Equal(startKey, sub.endKey) {
 		select {
 		case <-t.ctx.Done():
-			t.canceled = true
 			return nil
 		default:
 		}
 
-		loc, err := t.store.GetRegionCache().LocateKey(t.bo, startKey)
+		loc, err := t.backend.LocateKey(t.bo, startKey)
 		if err != nil {
 			return errors.Trace(err)
 		}
-
 		endKey := loc.EndKey
-		if loc.Contains(rangeEndKey) {
-			endKey = rangeEndKey
+		if loc.Contains(sub.endKey) {
+			endKey = sub.endKey
 		}
 
 		req := &tikvrpc.Request{
@@ -77,7 +218,7 @@ func (t DeleteRangeTask) Execute() error {
 			},
 		}
 
-		resp, err := t.store.SendReq(t.bo, req, loc.Region, ReadTimeoutMedium)
+		resp, err := t.backend.SendReq(t.bo, req, loc.Region, ReadTimeoutMedium)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -86,8 +227,7 @@ func (t DeleteRangeTask) Execute() error {
 			return errors.Trace(err)
 		}
 		if regionErr != nil {
-			err = t.bo.Backoff(BoRegionMiss, errors.New(regionErr.String()))
-			if err != nil {
+			if err := t.backend.Backoff(t.bo, BoRegionMiss, errors.New(regionErr.String())); err != nil {
 				return errors.Trace(err)
 			}
 			continue
@@ -96,25 +236,72 @@ func (t DeleteRangeTask) Execute() error {
 		if deleteRangeResp == nil {
 			return errors.Trace(ErrBodyMissing)
 		}
-		if err := deleteRangeResp.GetError(); err != "" {
-			return errors.Errorf("unexpected delete range err: %v", err)
+		if errStr := deleteRangeResp.GetError(); errStr != "" {
+			if lock := parseRawLockedErr(errStr); lock != nil {
+				callerStartTS, err := t.backend.CurrentTS(t.bo)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				resolved, err := t.lockResolver.ResolveLocks(t.bo, callerStartTS, []*Lock{lock})
+				if err != nil {
+					return errors.Trace(err)
+				}
+				if !resolved {
+					if err := t.backend.Backoff(t.bo, BoTxnLock, errors.New("lock not yet resolved, retrying")); err != nil {
+						return errors.Trace(err)
+					}
+				}
+				continue
+			}
+			return errors.Errorf("unexpected delete range err: %v", errStr)
 		}
+
+		t.mu.Lock()
 		t.regions++
-		if bytes.Equal(endKey, rangeEndKey) {
-			break
+		if !first {
+			// sub was estimated as a single region but has since split into
+			// more than one; grow the estimate to match.
+			t.totalEstimated++
 		}
+		t.completed = append(t.completed, [2][]byte{startKey, endKey})
+		t.mu.Unlock()
+
+		first = false
 		startKey = endKey
 	}
-
 	return nil
 }
 
 // Regions returns the number of regions that are affected by this delete range task
-func (t DeleteRangeTask) Regions() int {
+func (t *DeleteRangeTask) Regions() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.regions
 }
 
 // IsCanceled returns true if the delete range operation was canceled on the half way
-func (t DeleteRangeTask) IsCanceled() bool {
+func (t *DeleteRangeTask) IsCanceled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.canceled
 }
+
+// Progress returns how many regions have been fully deleted so far and the
+// estimated total number of regions covered by the task. totalEstimated can
+// grow if regions split during the task, since a split region counts as
+// more than one originally-estimated sub-range.
+func (t *DeleteRangeTask) Progress() (completedRegions, totalEstimated int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.regions, t.totalEstimated
+}
+
+// CompletedRanges returns the [startKey, endKey) pairs that have been fully
+// deleted so far, for observers that want to checkpoint progress.
+func (t *DeleteRangeTask) CompletedRanges() [][2][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ranges := make([][2][]byte, len(t.completed))
+	copy(ranges, t.completed)
+	return ranges
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/pd/pd-client"
+	"github.com/pingcap/tidb/store/tikv/tikvrpc"
+	"golang.org/x/net/context"
+)
+
+// physicalShiftBits is the number of bits the physical part of a PD
+// timestamp is shifted left by to make room for the logical part, matching
+// the encoding PD itself uses.
+const physicalShiftBits = 18
+
+func composeTS(physical, logical int64) uint64 {
+	return uint64(physical<<physicalShiftBits + logical)
+}
+
+// KVBackend abstracts the region-aware request plumbing shared by
+// RawKVClient and DeleteRangeTask: locating which region owns a key, sending
+// a request to a region, and backing off between retries. Both TiKV and an
+// in-memory mock implement it the same way, so callers can be built and
+// tested without depending on a live Storage/RegionCache.
+type KVBackend interface {
+	// LocateKey returns the region that currently owns key.
+	LocateKey(bo *Backoffer, key []byte) (*KeyLocation, error)
+	// LocateEndKey returns the region whose range has key as its exclusive
+	// end, for walking a range backward. An empty key means "no upper
+	// bound" and locates the region holding the largest key in the store.
+	LocateEndKey(bo *Backoffer, key []byte) (*KeyLocation, error)
+	// SendReq sends req to the region identified by regionID.
+	SendReq(bo *Backoffer, req *tikvrpc.Request, regionID RegionVerID, timeout time.Duration) (*tikvrpc.Response, error)
+	// Backoff sleeps according to cfg before a retry, returning an error if
+	// the backoff budget has been exhausted.
+	Backoff(bo *Backoffer, cfg backoffType, err error) error
+	// CurrentTS returns a fresh timestamp from the backend's timestamp
+	// source, for use as the "current time" when checking whether a lock's
+	// owning transaction has exceeded its TTL.
+	CurrentTS(bo *Backoffer) (uint64, error)
+}
+
+// tikvKVBackend is the KVBackend implementation used by RawKVClient. It
+// talks directly to a live TiKV cluster via a RegionCache and rpc Client.
+type tikvKVBackend struct {
+	regionCache *RegionCache
+	rpcClient   Client
+	pdClient    pd.Client
+}
+
+// newTiKVBackend creates a KVBackend talking to a live TiKV cluster.
+func newTiKVBackend(regionCache *RegionCache, rpcClient Client, pdClient pd.Client) KVBackend {
+	return &tikvKVBackend{regionCache: regionCache, rpcClient: rpcClient, pdClient: pdClient}
+}
+
+func (b *tikvKVBackend) LocateKey(bo *Backoffer, key []byte) (*KeyLocation, error) {
+	loc, err := b.regionCache.LocateKey(bo, key)
+	return loc, errors.Trace(err)
+}
+
+func (b *tikvKVBackend) LocateEndKey(bo *Backoffer, key []byte) (*KeyLocation, error) {
+	loc, err := b.regionCache.LocateEndKey(bo, key)
+	return loc, errors.Trace(err)
+}
+
+func (b *tikvKVBackend) SendReq(bo *Backoffer, req *tikvrpc.Request, regionID RegionVerID, timeout time.Duration) (*tikvrpc.Response, error) {
+	sender := NewRegionRequestSender(b.regionCache, b.rpcClient)
+	resp, err := sender.SendReq(bo, req, regionID, timeout)
+	return resp, errors.Trace(err)
+}
+
+func (b *tikvKVBackend) Backoff(bo *Backoffer, cfg backoffType, err error) error {
+	return errors.Trace(bo.Backoff(cfg, err))
+}
+
+func (b *tikvKVBackend) CurrentTS(bo *Backoffer) (uint64, error) {
+	physical, logical, err := b.pdClient.GetTS(context.Background())
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return composeTS(physical, logical), nil
+}
+
+// storageKVBackend is the KVBackend implementation used by DeleteRangeTask
+// when it is constructed from an existing transactional Storage. It simply
+// forwards to the Storage's own region cache and request sender.
+type storageKVBackend struct {
+	store Storage
+}
+
+// newStorageKVBackend adapts a Storage (as used by the transactional
+// client) into a KVBackend, so DeleteRangeTask can keep being constructed
+// from a Storage without its callers knowing about KVBackend.
+func newStorageKVBackend(store Storage) KVBackend {
+	return &storageKVBackend{store: store}
+}
+
+func (b *storageKVBackend) LocateKey(bo *Backoffer, key []byte) (*KeyLocation, error) {
+	loc, err := b.store.GetRegionCache().LocateKey(bo, key)
+	return loc, errors.Trace(err)
+}
+
+func (b *storageKVBackend) LocateEndKey(bo *Backoffer, key []byte) (*KeyLocation, error) {
+	loc, err := b.store.GetRegionCache().LocateEndKey(bo, key)
+	return loc, errors.Trace(err)
+}
+
+func (b *storageKVBackend) SendReq(bo *Backoffer, req *tikvrpc.Request, regionID RegionVerID, timeout time.Duration) (*tikvrpc.Response, error) {
+	resp, err := b.store.SendReq(bo, req, regionID, timeout)
+	return resp, errors.Trace(err)
+}
+
+func (b *storageKVBackend) Backoff(bo *Backoffer, cfg backoffType, err error) error {
+	return errors.Trace(bo.Backoff(cfg, err))
+}
+
+func (b *storageKVBackend) CurrentTS(bo *Backoffer) (uint64, error) {
+	ts, err := b.store.GetOracle().GetTimestamp(context.Background())
+	return ts, errors.Trace(err)
+}
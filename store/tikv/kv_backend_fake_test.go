@@ -0,0 +1,417 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/store/tikv/tikvrpc"
+)
+
+// fakeRegion is one contiguous range of a fakeKVBackend's keyspace.
+type fakeRegion struct {
+	id       uint64
+	startKey []byte
+	endKey   []byte
+}
+
+func (r *fakeRegion) loc() *KeyLocation {
+	return &KeyLocation{Region: RegionVerID{id: r.id}, StartKey: r.startKey, EndKey: r.endKey}
+}
+
+// fakeLock is a pending txn lock left on a key, as understood by
+// RawLockResolver.
+type fakeLock struct {
+	txnID  uint64
+	alive  bool
+	commit uint64 // meaningful only when alive is false: 0 means rolled back.
+}
+
+// fakeKVBackend is a minimal in-memory KVBackend. It supports just enough of
+// CmdDeleteRange, CmdRawScan, CmdRawGet/Put/Delete, CmdRawBatchGet/Put/Delete,
+// CmdRawBackup/CmdRawIngest, CmdCheckTxnStatus and CmdResolveLock to drive
+// DeleteRangeTask, RawKVClient and RawLockResolver in tests, without
+// spinning up a real TiKV cluster.
+type fakeKVBackend struct {
+	mu            sync.Mutex
+	regions       []*fakeRegion // sorted by startKey, covers the whole keyspace
+	data          map[string][]byte
+	locks         map[string]*fakeLock // keyed by primary key
+	blocked       map[string]*Lock     // data key -> lock blocking raw access to it
+	pendingSplit  map[uint64][]byte    // region id -> key to split at, on its next CmdDeleteRange
+	forceErr      map[uint64]string    // region id -> CmdDeleteRange error to return instead of deleting
+	regionErrOnce map[uint64]bool      // region id -> return one RegionError on its next CmdRawBatchGet
+}
+
+// newFakeKVBackend creates a fakeKVBackend whose keyspace is pre-split at
+// boundaries, with the given key/value pairs already present.
+func newFakeKVBackend(boundaries [][]byte, kvs map[string][]byte) *fakeKVBackend {
+	b := &fakeKVBackend{
+		data:          map[string][]byte{},
+		locks:         map[string]*fakeLock{},
+		blocked:       map[string]*Lock{},
+		pendingSplit:  map[uint64][]byte{},
+		forceErr:      map[uint64]string{},
+		regionErrOnce: map[uint64]bool{},
+	}
+	start := []byte(nil)
+	var id uint64 = 1
+	for _, end := range boundaries {
+		b.regions = append(b.regions, &fakeRegion{id: id, startKey: start, endKey: end})
+		start = end
+		id++
+	}
+	b.regions = append(b.regions, &fakeRegion{id: id, startKey: start, endKey: nil})
+	for k, v := range kvs {
+		b.data[k] = v
+	}
+	return b
+}
+
+// splitRegionOnNextRequest arranges for the region owning key to return a
+// RegionError exactly once, the next time a CmdDeleteRange request touches
+// it, and to have split into two (at splitAt) by the time the caller
+// re-locates it - the same sequence a real cluster produces when a region
+// splits mid-task.
+func (b *fakeKVBackend) splitRegionOnNextRequest(key, splitAt []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.locateLocked(key)
+	b.pendingSplit[r.id] = splitAt
+}
+
+func (b *fakeKVBackend) locateLocked(key []byte) *fakeRegion {
+	for _, r := range b.regions {
+		if bytes.Compare(key, r.startKey) >= 0 && (len(r.endKey) == 0 || bytes.Compare(key, r.endKey) < 0) {
+			return r
+		}
+	}
+	return b.regions[len(b.regions)-1]
+}
+
+func (b *fakeKVBackend) LocateKey(bo *Backoffer, key []byte) (*KeyLocation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.locateLocked(key).loc(), nil
+}
+
+func (b *fakeKVBackend) LocateEndKey(bo *Backoffer, key []byte) (*KeyLocation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(key) == 0 {
+		return b.regions[len(b.regions)-1].loc(), nil
+	}
+	for _, r := range b.regions {
+		if bytes.Compare(r.startKey, key) < 0 && (len(r.endKey) == 0 || bytes.Compare(key, r.endKey) <= 0) {
+			return r.loc(), nil
+		}
+	}
+	return nil, errors.New("fakeKVBackend: no region ends at key")
+}
+
+func (b *fakeKVBackend) Backoff(bo *Backoffer, cfg backoffType, err error) error {
+	return nil
+}
+
+// CurrentTS returns a timestamp strictly greater than any txnID used by the
+// tests, so a lock's elapsed time is always positive.
+func (b *fakeKVBackend) CurrentTS(bo *Backoffer) (uint64, error) {
+	return 1 << 40, nil
+}
+
+// setLock plants a lock on primary, as if a transactional write had left it
+// there for RawLockResolver to find.
+func (b *fakeKVBackend) setLock(primary string, lock *fakeLock) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.locks[primary] = lock
+}
+
+// forceDeleteRangeError makes every CmdDeleteRange against the region owning
+// key fail with msg instead of deleting, simulating an RPC-level failure.
+func (b *fakeKVBackend) forceDeleteRangeError(key []byte, msg string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.locateLocked(key)
+	b.forceErr[r.id] = msg
+}
+
+// forceRegionErrorOnce makes the next CmdRawBatchGet against the region
+// owning key return a RegionError instead of being served. Other request
+// types ignore it.
+func (b *fakeKVBackend) forceRegionErrorOnce(key []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.locateLocked(key)
+	b.regionErrOnce[r.id] = true
+}
+
+func (b *fakeKVBackend) takeRegionErrOnceLocked(id uint64) bool {
+	if b.regionErrOnce[id] {
+		delete(b.regionErrOnce, id)
+		return true
+	}
+	return false
+}
+
+// blockKey makes every raw Get/Put/Delete against key fail with the
+// "key is locked" error string lock describes, as if a transactional write
+// had left a lock on it, until lock's txn is resolved via CmdResolveLock.
+func (b *fakeKVBackend) blockKey(key []byte, lock *Lock) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocked[string(key)] = lock
+}
+
+// formatRawLockedErr renders lock the same way a raw command's bare string
+// error would encode it, matching parseRawLockedErr's expected format.
+func formatRawLockedErr(lock *Lock) string {
+	return fmt.Sprintf(rawLockedErrPrefix+" key=%x primary=%x txnID=%d ttl=%d", lock.Key, lock.Primary, lock.TxnID, lock.TTL)
+}
+
+func (b *fakeKVBackend) SendReq(bo *Backoffer, req *tikvrpc.Request, regionID RegionVerID, timeout time.Duration) (*tikvrpc.Response, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch req.Type {
+	case tikvrpc.CmdDeleteRange:
+		r := b.regionByID(regionID.id)
+		if r == nil {
+			return nil, errors.New("fakeKVBackend: unknown region")
+		}
+		if at, scheduled := b.pendingSplit[r.id]; scheduled {
+			delete(b.pendingSplit, r.id)
+			b.splitRegionLocked(r, at)
+			return &tikvrpc.Response{Type: tikvrpc.CmdDeleteRange, DeleteRange: &kvrpcpb.DeleteRangeResponse{
+				RegionError: &errorpb.Error{Message: "region split"},
+			}}, nil
+		}
+		if msg, forced := b.forceErr[r.id]; forced {
+			return &tikvrpc.Response{Type: tikvrpc.CmdDeleteRange, DeleteRange: &kvrpcpb.DeleteRangeResponse{Error: msg}}, nil
+		}
+		for k := range b.data {
+			if bytes.Compare([]byte(k), req.DeleteRange.StartKey) >= 0 && bytes.Compare([]byte(k), req.DeleteRange.EndKey) < 0 {
+				delete(b.data, k)
+			}
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdDeleteRange, DeleteRange: &kvrpcpb.DeleteRangeResponse{}}, nil
+
+	case tikvrpc.CmdRawScan:
+		r := b.regionByID(regionID.id)
+		if r == nil {
+			return nil, errors.New("fakeKVBackend: unknown region")
+		}
+		// A real region server only ever holds its own region's data, so
+		// clip the scan to r's boundaries in addition to the request's -
+		// the request's StartKey/EndKey describe the caller's overall
+		// range, which may extend past this region.
+		lo := req.RawScan.StartKey
+		if bytes.Compare(r.startKey, lo) > 0 {
+			lo = r.startKey
+		}
+		hi := req.RawScan.EndKey
+		if len(r.endKey) > 0 && (len(hi) == 0 || bytes.Compare(r.endKey, hi) < 0) {
+			hi = r.endKey
+		}
+		var kvs []*kvrpcpb.KvPair
+		var keys [][]byte
+		for k := range b.data {
+			if bytes.Compare([]byte(k), lo) >= 0 && (len(hi) == 0 || bytes.Compare([]byte(k), hi) < 0) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		sortKeys(keys, req.RawScan.Reverse)
+		for _, k := range keys {
+			if uint32(len(kvs)) >= req.RawScan.Limit {
+				break
+			}
+			kvs = append(kvs, &kvrpcpb.KvPair{Key: k, Value: b.data[string(k)]})
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdRawScan, RawScan: &kvrpcpb.RawScanResponse{Kvs: kvs}}, nil
+
+	case tikvrpc.CmdRawGet:
+		if lock, blocked := b.blocked[string(req.RawGet.Key)]; blocked {
+			return &tikvrpc.Response{Type: tikvrpc.CmdRawGet, RawGet: &kvrpcpb.RawGetResponse{Error: formatRawLockedErr(lock)}}, nil
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdRawGet, RawGet: &kvrpcpb.RawGetResponse{Value: b.data[string(req.RawGet.Key)]}}, nil
+
+	case tikvrpc.CmdRawPut:
+		if lock, blocked := b.blocked[string(req.RawPut.Key)]; blocked {
+			return &tikvrpc.Response{Type: tikvrpc.CmdRawPut, RawPut: &kvrpcpb.RawPutResponse{Error: formatRawLockedErr(lock)}}, nil
+		}
+		b.data[string(req.RawPut.Key)] = req.RawPut.Value
+		return &tikvrpc.Response{Type: tikvrpc.CmdRawPut, RawPut: &kvrpcpb.RawPutResponse{}}, nil
+
+	case tikvrpc.CmdRawDelete:
+		if lock, blocked := b.blocked[string(req.RawDelete.Key)]; blocked {
+			return &tikvrpc.Response{Type: tikvrpc.CmdRawDelete, RawDelete: &kvrpcpb.RawDeleteResponse{Error: formatRawLockedErr(lock)}}, nil
+		}
+		delete(b.data, string(req.RawDelete.Key))
+		return &tikvrpc.Response{Type: tikvrpc.CmdRawDelete, RawDelete: &kvrpcpb.RawDeleteResponse{}}, nil
+
+	case tikvrpc.CmdRawBatchGet:
+		if b.takeRegionErrOnceLocked(regionID.id) {
+			return &tikvrpc.Response{Type: tikvrpc.CmdRawBatchGet, RawBatchGet: &kvrpcpb.RawBatchGetResponse{
+				RegionError: &errorpb.Error{Message: "region error"},
+			}}, nil
+		}
+		var pairs []*kvrpcpb.KvPair
+		for _, k := range req.RawBatchGet.Keys {
+			if v, ok := b.data[string(k)]; ok {
+				pairs = append(pairs, &kvrpcpb.KvPair{Key: k, Value: v})
+			}
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdRawBatchGet, RawBatchGet: &kvrpcpb.RawBatchGetResponse{Pairs: pairs}}, nil
+
+	case tikvrpc.CmdRawBatchPut:
+		for _, pair := range req.RawBatchPut.Pairs {
+			b.data[string(pair.Key)] = pair.Value
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdRawBatchPut, RawBatchPut: &kvrpcpb.RawBatchPutResponse{}}, nil
+
+	case tikvrpc.CmdRawBatchDelete:
+		for _, k := range req.RawBatchDelete.Keys {
+			delete(b.data, string(k))
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdRawBatchDelete, RawBatchDelete: &kvrpcpb.RawBatchDeleteResponse{}}, nil
+
+	case tikvrpc.CmdRawBackup:
+		kvs := map[string][]byte{}
+		for k, v := range b.data {
+			if bytes.Compare([]byte(k), req.RawBackup.StartKey) >= 0 &&
+				(len(req.RawBackup.EndKey) == 0 || bytes.Compare([]byte(k), req.RawBackup.EndKey) < 0) {
+				kvs[k] = v
+			}
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdRawBackup, RawBackup: &kvrpcpb.BackupResponse{SstData: encodeFakeSST(kvs)}}, nil
+
+	case tikvrpc.CmdRawIngest:
+		for k, v := range decodeFakeSST(req.RawIngest.SstData) {
+			b.data[k] = v
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdRawIngest, RawIngest: &kvrpcpb.RawIngestResponse{}}, nil
+
+	case tikvrpc.CmdCheckTxnStatus:
+		lock := b.locks[string(req.CheckTxnStatus.PrimaryKey)]
+		if lock == nil || !lock.alive {
+			return &tikvrpc.Response{Type: tikvrpc.CmdCheckTxnStatus, CheckTxnStatus: &kvrpcpb.CheckTxnStatusResponse{
+				CommitVersion: lockOrZeroCommit(lock),
+			}}, nil
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdCheckTxnStatus, CheckTxnStatus: &kvrpcpb.CheckTxnStatusResponse{
+			LockTtl: 1000,
+		}}, nil
+
+	case tikvrpc.CmdResolveLock:
+		for key, lock := range b.locks {
+			if lock.txnID == req.ResolveLock.StartVersion {
+				delete(b.locks, key)
+			}
+		}
+		for key, lock := range b.blocked {
+			if lock.TxnID == req.ResolveLock.StartVersion {
+				delete(b.blocked, key)
+			}
+		}
+		return &tikvrpc.Response{Type: tikvrpc.CmdResolveLock, ResolveLock: &kvrpcpb.ResolveLockResponse{}}, nil
+	}
+	return nil, errors.Errorf("fakeKVBackend: unsupported request type %v", req.Type)
+}
+
+func lockOrZeroCommit(lock *fakeLock) uint64 {
+	if lock == nil {
+		return 0
+	}
+	return lock.commit
+}
+
+func (b *fakeKVBackend) regionByID(id uint64) *fakeRegion {
+	for _, r := range b.regions {
+		if r.id == id {
+			return r
+		}
+	}
+	return nil
+}
+
+func (b *fakeKVBackend) splitRegionLocked(r *fakeRegion, at []byte) {
+	var maxID uint64
+	for _, existing := range b.regions {
+		if existing.id > maxID {
+			maxID = existing.id
+		}
+	}
+	left := &fakeRegion{id: r.id, startKey: r.startKey, endKey: at}
+	right := &fakeRegion{id: maxID + 1, startKey: at, endKey: r.endKey}
+	regions := make([]*fakeRegion, 0, len(b.regions)+1)
+	for _, existing := range b.regions {
+		if existing == r {
+			regions = append(regions, left, right)
+			continue
+		}
+		regions = append(regions, existing)
+	}
+	b.regions = regions
+}
+
+func sortKeys(keys [][]byte, reverse bool) {
+	sort.Slice(keys, func(i, j int) bool {
+		if reverse {
+			return bytes.Compare(keys[i], keys[j]) > 0
+		}
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+}
+
+// encodeFakeSST and decodeFakeSST stand in for TiKV's real SST wire format,
+// which is opaque to RawKVClient: Backup/Restore only ever treat it as an
+// uninterpreted byte blob passed through BackupStorage, so any length-
+// prefixed encoding that round-trips is enough to exercise that path.
+func encodeFakeSST(kvs map[string][]byte) []byte {
+	var buf bytes.Buffer
+	var lenBuf [4]byte
+	for k, v := range kvs {
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(k)))
+		buf.Write(lenBuf[:])
+		buf.WriteString(k)
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(v)))
+		buf.Write(lenBuf[:])
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
+
+func decodeFakeSST(data []byte) map[string][]byte {
+	out := map[string][]byte{}
+	for len(data) > 0 {
+		klen := binary.BigEndian.Uint32(data[:4])
+		data = data[4:]
+		k := data[:klen]
+		data = data[klen:]
+		vlen := binary.BigEndian.Uint32(data[:4])
+		data = data[4:]
+		v := data[:vlen]
+		data = data[vlen:]
+		out[string(k)] = v
+	}
+	return out
+}
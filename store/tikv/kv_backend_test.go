@@ -0,0 +1,227 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDeleteRangeTaskSplitGrowsEstimate(t *testing.T) {
+	backend := newFakeKVBackend([][]byte{[]byte("m")}, map[string][]byte{
+		"a": []byte("1"), "b": []byte("2"), "n": []byte("3"), "o": []byte("4"),
+	})
+	backend.splitRegionOnNextRequest([]byte("a"), []byte("c"))
+
+	bo := NewBackoffer(context.Background(), rawkvMaxBackoff)
+	task := NewDeleteRangeTaskWithBackend(context.Background(), backend, bo, nil, []byte("z"))
+	task.SetConcurrency(1)
+	if err := task.Execute(); err != nil {
+		t.Fatalf("Execute() returned error: %v", err)
+	}
+	if task.IsCanceled() {
+		t.Fatalf("task reported canceled on a clean run")
+	}
+	if len(backend.data) != 0 {
+		t.Fatalf("expected all keys deleted, got %d left", len(backend.data))
+	}
+	completed, total := task.Progress()
+	if completed != 3 || total != 3 {
+		t.Fatalf("Progress() = (%d, %d), want totalEstimated to grow to match the 3 completed sub-ranges", completed, total)
+	}
+}
+
+func TestDeleteRangeTaskWorkerErrorNotSwallowed(t *testing.T) {
+	backend := newFakeKVBackend([][]byte{[]byte("m")}, map[string][]byte{
+		"a": []byte("1"), "n": []byte("2"),
+	})
+	backend.forceDeleteRangeError([]byte("a"), "boom")
+
+	bo := NewBackoffer(context.Background(), rawkvMaxBackoff)
+	task := NewDeleteRangeTaskWithBackend(context.Background(), backend, bo, nil, []byte("z"))
+	task.SetConcurrency(2)
+	err := task.Execute()
+	if err == nil {
+		t.Fatalf("Execute() returned nil, want the RPC error from the failing sub-range")
+	}
+	if !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("Execute() error = %v, want it to wrap the underlying RPC error", err)
+	}
+	if task.IsCanceled() {
+		t.Fatalf("task reported canceled, but it failed rather than being caller-canceled")
+	}
+}
+
+func TestRawLockResolverResolveLocks(t *testing.T) {
+	backend := newFakeKVBackend(nil, nil)
+	resolver := NewRawLockResolver(backend)
+	bo := NewBackoffer(context.Background(), rawkvMaxBackoff)
+
+	backend.setLock("alive-primary", &fakeLock{txnID: 1, alive: true})
+	ok, err := resolver.ResolveLocks(bo, 0, []*Lock{{Key: []byte("k1"), Primary: []byte("alive-primary"), TxnID: 1}})
+	if err != nil {
+		t.Fatalf("ResolveLocks() error for an alive txn: %v", err)
+	}
+	if ok {
+		t.Fatalf("ResolveLocks() ok = true for a still-alive txn, want false so the caller backs off")
+	}
+
+	backend.setLock("rolledback-primary", &fakeLock{txnID: 2, alive: false, commit: 0})
+	ok, err = resolver.ResolveLocks(bo, 0, []*Lock{{Key: []byte("k2"), Primary: []byte("rolledback-primary"), TxnID: 2}})
+	if err != nil {
+		t.Fatalf("ResolveLocks() error for a rolled-back txn: %v", err)
+	}
+	if !ok {
+		t.Fatalf("ResolveLocks() ok = false for a rolled-back txn, want true: a rolled-back lock must not be treated as alive")
+	}
+
+	backend.setLock("committed-primary", &fakeLock{txnID: 3, alive: false, commit: 100})
+	ok, err = resolver.ResolveLocks(bo, 0, []*Lock{{Key: []byte("k3"), Primary: []byte("committed-primary"), TxnID: 3}})
+	if err != nil {
+		t.Fatalf("ResolveLocks() error for a committed txn: %v", err)
+	}
+	if !ok {
+		t.Fatalf("ResolveLocks() ok = false for a committed txn, want true")
+	}
+}
+
+func TestRawKVClientGetResolvesLockedErrorAndRetries(t *testing.T) {
+	backend := newFakeKVBackend(nil, map[string][]byte{"k": []byte("v")})
+	backend.setLock("primary", &fakeLock{txnID: 7, alive: false, commit: 0})
+	backend.blockKey([]byte("k"), &Lock{Key: []byte("k"), Primary: []byte("primary"), TxnID: 7, TTL: 1000})
+
+	client := NewRawKVClientWithBackend(backend)
+	val, err := client.Get([]byte("k"))
+	if err != nil {
+		t.Fatalf("Get() error = %v, want the locked error to be resolved and the request retried", err)
+	}
+	if string(val) != "v" {
+		t.Fatalf("Get() = %q, want %q", val, "v")
+	}
+}
+
+func TestRawKVClientBatchGetDuplicateKeys(t *testing.T) {
+	backend := newFakeKVBackend([][]byte{[]byte("m")}, map[string][]byte{
+		"a": []byte("1"), "n": []byte("2"),
+	})
+	client := NewRawKVClientWithBackend(backend)
+
+	values, err := client.BatchGet([][]byte{[]byte("a"), []byte("a"), []byte("n")})
+	if err != nil {
+		t.Fatalf("BatchGet() error: %v", err)
+	}
+	want := []string{"1", "1", "2"}
+	for i, w := range want {
+		if string(values[i]) != w {
+			t.Fatalf("BatchGet()[%d] = %q, want %q: every position of a repeated key must be filled, not just the last", i, values[i], w)
+		}
+	}
+}
+
+func TestRawKVClientBatchGetRetriesOnRegionError(t *testing.T) {
+	backend := newFakeKVBackend(nil, map[string][]byte{"a": []byte("1")})
+	backend.forceRegionErrorOnce([]byte("a"))
+
+	client := NewRawKVClientWithBackend(backend)
+	values, err := client.BatchGet([][]byte{[]byte("a")})
+	if err != nil {
+		t.Fatalf("BatchGet() error: %v", err)
+	}
+	if string(values[0]) != "1" {
+		t.Fatalf("BatchGet()[0] = %q, want %q after retrying past the region error", values[0], "1")
+	}
+}
+
+func TestRawKVClientScanRangeAcrossRegions(t *testing.T) {
+	backend := newFakeKVBackend([][]byte{[]byte("m")}, map[string][]byte{
+		"a": []byte("1"), "b": []byte("2"), "n": []byte("3"),
+	})
+	client := NewRawKVClientWithBackend(backend)
+
+	keys, values, err := client.ScanRange([]byte("a"), nil, 10)
+	if err != nil {
+		t.Fatalf("ScanRange() error: %v", err)
+	}
+	wantKeys := []string{"a", "b", "n"}
+	wantValues := []string{"1", "2", "3"}
+	if len(keys) != len(wantKeys) {
+		t.Fatalf("ScanRange() returned %d keys, want %d", len(keys), len(wantKeys))
+	}
+	for i := range wantKeys {
+		if string(keys[i]) != wantKeys[i] || string(values[i]) != wantValues[i] {
+			t.Fatalf("ScanRange()[%d] = (%q, %q), want (%q, %q)", i, keys[i], values[i], wantKeys[i], wantValues[i])
+		}
+	}
+}
+
+func TestRawKVClientReverseScan(t *testing.T) {
+	backend := newFakeKVBackend([][]byte{[]byte("m")}, map[string][]byte{
+		"a": []byte("1"), "b": []byte("2"), "n": []byte("3"),
+	})
+	client := NewRawKVClientWithBackend(backend)
+
+	keys, values, err := client.ReverseScan(nil, 10)
+	if err != nil {
+		t.Fatalf("ReverseScan() error: %v", err)
+	}
+	wantKeys := []string{"n", "b", "a"}
+	wantValues := []string{"3", "2", "1"}
+	if len(keys) != len(wantKeys) {
+		t.Fatalf("ReverseScan() returned %d keys, want %d", len(keys), len(wantKeys))
+	}
+	for i := range wantKeys {
+		if string(keys[i]) != wantKeys[i] || string(values[i]) != wantValues[i] {
+			t.Fatalf("ReverseScan()[%d] = (%q, %q), want (%q, %q)", i, keys[i], values[i], wantKeys[i], wantValues[i])
+		}
+	}
+}
+
+func TestRawKVClientBackupRestoreRoundTrip(t *testing.T) {
+	backend := newFakeKVBackend([][]byte{[]byte("m")}, map[string][]byte{
+		"a": []byte("1"), "b": []byte("2"), "n": []byte("3"),
+	})
+	client := NewRawKVClientWithBackend(backend)
+
+	dir, err := ioutil.TempDir("", "rawkv-backup-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := NewLocalBackupStorage(dir)
+	if err != nil {
+		t.Fatalf("NewLocalBackupStorage: %v", err)
+	}
+
+	meta, err := client.Backup(context.Background(), []byte("a"), []byte("o"), storage)
+	if err != nil {
+		t.Fatalf("Backup() error: %v", err)
+	}
+	if len(meta.Files) != 2 {
+		t.Fatalf("Backup() produced %d files, want 2 (one per region)", len(meta.Files))
+	}
+
+	restored := newFakeKVBackend([][]byte{[]byte("m")}, nil)
+	if err := NewRawKVClientWithBackend(restored).Restore(context.Background(), meta, storage); err != nil {
+		t.Fatalf("Restore() error: %v", err)
+	}
+	want := map[string]string{"a": "1", "b": "2", "n": "3"}
+	for k, w := range want {
+		if got := string(restored.data[k]); got != w {
+			t.Fatalf("restored data[%q] = %q, want %q", k, got, w)
+		}
+	}
+}
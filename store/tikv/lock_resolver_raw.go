@@ -0,0 +1,187 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/store/tikv/tikvrpc"
+)
+
+// Lock is the minimal description of a lock left behind by the
+// transactional API that a raw-mode caller can run into when its range
+// overlaps txn-written keys.
+type Lock struct {
+	Key     []byte
+	Primary []byte
+	TxnID   uint64
+	TTL     uint64
+}
+
+// NewLockFromLockInfo builds a Lock from the LockInfo embedded in a
+// kvrpcpb.KeyError.
+func NewLockFromLockInfo(info *kvrpcpb.LockInfo) *Lock {
+	return &Lock{
+		Key:     info.Key,
+		Primary: info.PrimaryLock,
+		TxnID:   info.LockVersion,
+		TTL:     info.LockTtl,
+	}
+}
+
+// rawLockedErrPrefix marks the plain-string raw command errors that encode a
+// KeyError{Locked}. Raw responses carry a bare string error rather than a
+// structured kvrpcpb.KeyError, so this is how TiKV reports that a raw
+// request hit a key still locked by the transactional API, until the raw
+// protobufs grow a proper KeyError field.
+const rawLockedErrPrefix = "key is locked"
+
+// parseRawLockedErr recovers the Lock encoded in a raw command's error
+// string, or returns nil if errStr does not describe a lock.
+func parseRawLockedErr(errStr string) *Lock {
+	if !strings.HasPrefix(errStr, rawLockedErrPrefix) {
+		return nil
+	}
+	var key, primary string
+	var txnID, ttl uint64
+	if _, err := fmt.Sscanf(errStr, rawLockedErrPrefix+" key=%x primary=%x txnID=%d ttl=%d", &key, &primary, &txnID, &ttl); err != nil {
+		return nil
+	}
+	return &Lock{Key: []byte(key), Primary: []byte(primary), TxnID: txnID, TTL: ttl}
+}
+
+// RawLockResolver resolves locks left behind by the transactional API on
+// behalf of raw-mode callers (RawKVClient, DeleteRangeTask). It depends only
+// on KVBackend rather than on Store directly, so it can be constructed
+// wherever a KVBackend is available.
+type RawLockResolver struct {
+	backend KVBackend
+}
+
+// NewRawLockResolver creates a RawLockResolver that resolves locks through backend.
+func NewRawLockResolver(backend KVBackend) *RawLockResolver {
+	return &RawLockResolver{backend: backend}
+}
+
+// ResolveLocks checks the status of each lock's primary and, for those
+// belonging to a committed or rolled-back transaction, asks TiKV to clean
+// them up. It returns ok == true only if every lock has been resolved; if
+// any lock's transaction is still alive it returns ok == false, and the
+// caller should back off and retry the original request.
+func (r *RawLockResolver) ResolveLocks(bo *Backoffer, callerStartTS uint64, locks []*Lock) (ok bool, err error) {
+	ok = true
+	for _, l := range locks {
+		status, err := r.checkTxnStatus(bo, callerStartTS, l)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if status.isAlive() {
+			ok = false
+			continue
+		}
+		if err := r.resolveLock(bo, l, status); err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+	return ok, nil
+}
+
+// txnStatus is the outcome of CmdCheckTxnStatus for a single lock's txn.
+// commitTS is only meaningful when alive is false: 0 means the txn was
+// rolled back, >0 is the commit version of a committed txn.
+type txnStatus struct {
+	alive    bool
+	commitTS uint64
+}
+
+func (s txnStatus) isAlive() bool {
+	return s.alive
+}
+
+func (r *RawLockResolver) checkTxnStatus(bo *Backoffer, callerStartTS uint64, l *Lock) (txnStatus, error) {
+	req := &tikvrpc.Request{
+		Type: tikvrpc.CmdCheckTxnStatus,
+		CheckTxnStatus: &kvrpcpb.CheckTxnStatusRequest{
+			PrimaryKey: l.Primary,
+			LockTs:     l.TxnID,
+			CurrentTs:  callerStartTS,
+		},
+	}
+	loc, err := r.backend.LocateKey(bo, l.Primary)
+	if err != nil {
+		return txnStatus{}, errors.Trace(err)
+	}
+	resp, err := r.backend.SendReq(bo, req, loc.Region, readTimeoutShort)
+	if err != nil {
+		return txnStatus{}, errors.Trace(err)
+	}
+	regionErr, err := resp.GetRegionError()
+	if err != nil {
+		return txnStatus{}, errors.Trace(err)
+	}
+	if regionErr != nil {
+		if err := r.backend.Backoff(bo, BoRegionMiss, errors.New(regionErr.String())); err != nil {
+			return txnStatus{}, errors.Trace(err)
+		}
+		return r.checkTxnStatus(bo, callerStartTS, l)
+	}
+	cmdResp := resp.CheckTxnStatus
+	if cmdResp == nil {
+		return txnStatus{}, errors.Trace(ErrBodyMissing)
+	}
+	if cmdResp.LockTtl > 0 {
+		// The primary is still locked and has not expired: the txn is alive.
+		return txnStatus{alive: true}, nil
+	}
+	return txnStatus{commitTS: cmdResp.CommitVersion}, nil
+}
+
+func (r *RawLockResolver) resolveLock(bo *Backoffer, l *Lock, status txnStatus) error {
+	req := &tikvrpc.Request{
+		Type: tikvrpc.CmdResolveLock,
+		ResolveLock: &kvrpcpb.ResolveLockRequest{
+			StartVersion:  l.TxnID,
+			CommitVersion: status.commitTS,
+		},
+	}
+	loc, err := r.backend.LocateKey(bo, l.Key)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp, err := r.backend.SendReq(bo, req, loc.Region, readTimeoutShort)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	regionErr, err := resp.GetRegionError()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if regionErr != nil {
+		if err := r.backend.Backoff(bo, BoRegionMiss, errors.New(regionErr.String())); err != nil {
+			return errors.Trace(err)
+		}
+		return r.resolveLock(bo, l, status)
+	}
+	cmdResp := resp.ResolveLock
+	if cmdResp == nil {
+		return errors.Trace(ErrBodyMissing)
+	}
+	if cmdResp.GetError() != nil {
+		return errors.New(cmdResp.GetError().String())
+	}
+	return nil
+}
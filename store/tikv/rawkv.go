@@ -14,6 +14,7 @@
 package tikv
 
 import (
+	"sync"
 	"time"
 
 	"github.com/juju/errors"
@@ -33,13 +34,18 @@ var (
 	ErrMaxScanLimitExceeded = errors.New("limit should be less than MaxRawKVScanLimit")
 )
 
+// rawBatchPairCount is the maximum number of concurrent per-region RPCs a
+// batch operation will have in flight at once.
+const rawBatchPairCount = 16
+
 // RawKVClient is a client of TiKV server which is used as a key-value storage,
 // only GET/PUT/DELETE commands are supported.
 type RawKVClient struct {
-	clusterID   uint64
-	regionCache *RegionCache
-	pdClient    pd.Client
-	rpcClient   Client
+	clusterID    uint64
+	pdClient     pd.Client
+	rpcClient    Client
+	backend      KVBackend
+	lockResolver *RawLockResolver
 }
 
 // NewRawKVClient creates a client with PD cluster addrs.
@@ -52,14 +58,30 @@ func NewRawKVClient(pdAddrs []string, security config.Security) (*RawKVClient, e
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	regionCache := NewRegionCache(pdCli)
+	rpcClient := newRPCClient(security)
+	backend := newTiKVBackend(regionCache, rpcClient, pdCli)
 	return &RawKVClient{
-		clusterID:   pdCli.GetClusterID(context.TODO()),
-		regionCache: NewRegionCache(pdCli),
-		pdClient:    pdCli,
-		rpcClient:   newRPCClient(security),
+		clusterID:    pdCli.GetClusterID(context.TODO()),
+		pdClient:     pdCli,
+		rpcClient:    rpcClient,
+		backend:      backend,
+		lockResolver: NewRawLockResolver(backend),
 	}, nil
 }
 
+// NewRawKVClientWithBackend creates a RawKVClient against an arbitrary
+// KVBackend, skipping PD/rpc client setup. This lets RawKVClient be driven
+// by a non-TiKV backend, e.g. an in-memory mock for tests. Close must not be
+// called on a client created this way, since it has no pdClient/rpcClient
+// to close.
+func NewRawKVClientWithBackend(backend KVBackend) *RawKVClient {
+	return &RawKVClient{
+		backend:      backend,
+		lockResolver: NewRawLockResolver(backend),
+	}
+}
+
 // Close closes the client.
 func (c *RawKVClient) Close() error {
 	c.pdClient.Close()
@@ -156,9 +178,201 @@ func (c *RawKVClient) Delete(key []byte) error {
 	return nil
 }
 
+// BatchGet queries values for the given keys and returns them in the same
+// order, with nil for keys that do not exist.
+func (c *RawKVClient) BatchGet(keys [][]byte) ([][]byte, error) {
+	start := time.Now()
+	defer func() {
+		metrics.TiKVRawkvCmdHistogram.WithLabelValues("batch_get").Observe(time.Since(start).Seconds())
+	}()
+
+	bo := NewBackoffer(context.Background(), rawkvMaxBackoff)
+	values := make([][]byte, len(keys))
+	err := c.sendBatchReq(bo, keys, func(batchKeys [][]byte, indices []int) (*tikvrpc.Request, error) {
+		return &tikvrpc.Request{
+			Type:       tikvrpc.CmdRawBatchGet,
+			RawBatchGet: &kvrpcpb.RawBatchGetRequest{Keys: batchKeys},
+		}, nil
+	}, func(resp *tikvrpc.Response, indices []int, keyIndex map[string][]int) error {
+		cmdResp := resp.RawBatchGet
+		if cmdResp == nil {
+			return errors.Trace(ErrBodyMissing)
+		}
+		for _, pair := range cmdResp.Pairs {
+			// keys may repeat the same key more than once; fill in every
+			// position it occupies, not just the last one seen.
+			for _, idx := range keyIndex[string(pair.Key)] {
+				values[idx] = pair.Value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return values, nil
+}
+
+// BatchPut stores the given key-value pairs. keys and values must have the
+// same length.
+func (c *RawKVClient) BatchPut(keys, values [][]byte) error {
+	start := time.Now()
+	defer func() {
+		metrics.TiKVRawkvCmdHistogram.WithLabelValues("batch_put").Observe(time.Since(start).Seconds())
+	}()
+	if len(keys) != len(values) {
+		return errors.New("the len of keys is not equal to the len of values")
+	}
+
+	bo := NewBackoffer(context.Background(), rawkvMaxBackoff)
+	return c.sendBatchReq(bo, keys, func(batchKeys [][]byte, indices []int) (*tikvrpc.Request, error) {
+		pairs := make([]*kvrpcpb.KvPair, len(indices))
+		for i, idx := range indices {
+			pairs[i] = &kvrpcpb.KvPair{Key: keys[idx], Value: values[idx]}
+		}
+		return &tikvrpc.Request{
+			Type:        tikvrpc.CmdRawBatchPut,
+			RawBatchPut: &kvrpcpb.RawBatchPutRequest{Pairs: pairs},
+		}, nil
+	}, func(resp *tikvrpc.Response, indices []int, keyIndex map[string][]int) error {
+		cmdResp := resp.RawBatchPut
+		if cmdResp == nil {
+			return errors.Trace(ErrBodyMissing)
+		}
+		if cmdResp.GetError() != "" {
+			return errors.New(cmdResp.GetError())
+		}
+		return nil
+	})
+}
+
+// BatchDelete deletes the given keys.
+func (c *RawKVClient) BatchDelete(keys [][]byte) error {
+	start := time.Now()
+	defer func() {
+		metrics.TiKVRawkvCmdHistogram.WithLabelValues("batch_delete").Observe(time.Since(start).Seconds())
+	}()
+
+	bo := NewBackoffer(context.Background(), rawkvMaxBackoff)
+	return c.sendBatchReq(bo, keys, func(batchKeys [][]byte, indices []int) (*tikvrpc.Request, error) {
+		return &tikvrpc.Request{
+			Type:           tikvrpc.CmdRawBatchDelete,
+			RawBatchDelete: &kvrpcpb.RawBatchDeleteRequest{Keys: batchKeys},
+		}, nil
+	}, func(resp *tikvrpc.Response, indices []int, keyIndex map[string][]int) error {
+		cmdResp := resp.RawBatchDelete
+		if cmdResp == nil {
+			return errors.Trace(ErrBodyMissing)
+		}
+		if cmdResp.GetError() != "" {
+			return errors.New(cmdResp.GetError())
+		}
+		return nil
+	})
+}
+
+// sendBatchReq groups keys by region, dispatches one RPC per region
+// (bounded by rawBatchPairCount concurrent in-flight requests), and calls
+// onResp with each region's response. If a region returns a RegionError,
+// the affected keys are re-located and retried.
+func (c *RawKVClient) sendBatchReq(
+	bo *Backoffer,
+	keys [][]byte,
+	buildReq func(batchKeys [][]byte, indices []int) (*tikvrpc.Request, error),
+	onResp func(resp *tikvrpc.Response, indices []int, keyIndex map[string][]int) error,
+) error {
+	pending := make([]int, len(keys))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for len(pending) > 0 {
+		groups := make(map[RegionVerID][]int)
+		locs := make(map[RegionVerID]*KeyLocation)
+		for _, idx := range pending {
+			loc, err := c.backend.LocateKey(bo, keys[idx])
+			if err != nil {
+				return errors.Trace(err)
+			}
+			groups[loc.Region] = append(groups[loc.Region], idx)
+			locs[loc.Region] = loc
+		}
+
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			firstErr error
+			retry    []int
+			sem      = make(chan struct{}, rawBatchPairCount)
+		)
+		for region, indices := range groups {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(region RegionVerID, indices []int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				batchKeys := make([][]byte, len(indices))
+				keyIndex := make(map[string][]int, len(indices))
+				for i, idx := range indices {
+					batchKeys[i] = keys[idx]
+					keyIndex[string(keys[idx])] = append(keyIndex[string(keys[idx])], idx)
+				}
+
+				req, err := buildReq(batchKeys, indices)
+				if err != nil {
+					mu.Lock()
+					firstErr = err
+					mu.Unlock()
+					return
+				}
+
+				resp, err := c.backend.SendReq(bo, req, locs[region].Region, readTimeoutShort)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					firstErr = errors.Trace(err)
+					return
+				}
+				regionErr, err := resp.GetRegionError()
+				if err != nil {
+					firstErr = errors.Trace(err)
+					return
+				}
+				if regionErr != nil {
+					retry = append(retry, indices...)
+					return
+				}
+				if err := onResp(resp, indices, keyIndex); err != nil {
+					firstErr = err
+				}
+			}(region, indices)
+		}
+		wg.Wait()
+		if firstErr != nil {
+			return errors.Trace(firstErr)
+		}
+		if len(retry) > 0 {
+			if err := c.backend.Backoff(bo, BoRegionMiss, errors.New("region error in batch request, retrying")); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		pending = retry
+	}
+	return nil
+}
+
 // Scan queries continuous kv pairs, starts from startKey, up to limit pairs.
 // If you want to exclude the startKey, append a '\0' to the key: `Scan(append(startKey, '\0'), limit)`.
 func (c *RawKVClient) Scan(startKey []byte, limit int) (keys [][]byte, values [][]byte, err error) {
+	return c.ScanRange(startKey, nil, limit)
+}
+
+// ScanRange queries continuous kv pairs in [startKey, endKey), up to limit
+// pairs. If endKey is empty, the scan goes to the end of the keyspace. If
+// you want to exclude the startKey, append a '\0' to the key:
+// `ScanRange(append(startKey, '\0'), endKey, limit)`.
+func (c *RawKVClient) ScanRange(startKey, endKey []byte, limit int) (keys [][]byte, values [][]byte, err error) {
 	start := time.Now()
 	defer func() { metrics.TiKVRawkvCmdHistogram.WithLabelValues("raw_scan").Observe(time.Since(start).Seconds()) }()
 
@@ -171,6 +385,7 @@ func (c *RawKVClient) Scan(startKey []byte, limit int) (keys [][]byte, values []
 			Type: tikvrpc.CmdRawScan,
 			RawScan: &kvrpcpb.RawScanRequest{
 				StartKey: startKey,
+				EndKey:   endKey,
 				Limit:    uint32(limit - len(keys)),
 			},
 		}
@@ -186,7 +401,12 @@ func (c *RawKVClient) Scan(startKey []byte, limit int) (keys [][]byte, values []
 			keys = append(keys, pair.Key)
 			values = append(values, pair.Value)
 		}
-		startKey = loc.EndKey
+		regionEndKey := loc.EndKey
+		if len(endKey) > 0 && (len(regionEndKey) == 0 || bytes.Compare(endKey, regionEndKey) < 0) {
+			// The requested range ends within this region; we're done.
+			break
+		}
+		startKey = regionEndKey
 		if len(startKey) == 0 {
 			break
 		}
@@ -194,6 +414,64 @@ func (c *RawKVClient) Scan(startKey []byte, limit int) (keys [][]byte, values []
 	return
 }
 
+// ReverseScan queries continuous kv pairs in the reverse order, starting
+// from endKey (exclusive) and walking backward, up to limit pairs.
+func (c *RawKVClient) ReverseScan(endKey []byte, limit int) (keys [][]byte, values [][]byte, err error) {
+	start := time.Now()
+	defer func() {
+		metrics.TiKVRawkvCmdHistogram.WithLabelValues("raw_reverse_scan").Observe(time.Since(start).Seconds())
+	}()
+
+	if limit > MaxRawKVScanLimit {
+		return nil, nil, errors.Trace(ErrMaxScanLimitExceeded)
+	}
+
+	bo := NewBackoffer(context.Background(), rawkvMaxBackoff)
+	for len(keys) < limit {
+		loc, err := c.backend.LocateEndKey(bo, endKey)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		req := &tikvrpc.Request{
+			Type: tikvrpc.CmdRawScan,
+			RawScan: &kvrpcpb.RawScanRequest{
+				StartKey: loc.StartKey,
+				EndKey:   endKey,
+				Limit:    uint32(limit - len(keys)),
+				Reverse:  true,
+			},
+		}
+		resp, err := c.backend.SendReq(bo, req, loc.Region, readTimeoutShort)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		regionErr, err := resp.GetRegionError()
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if regionErr != nil {
+			if err := c.backend.Backoff(bo, BoRegionMiss, errors.New(regionErr.String())); err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			continue
+		}
+		cmdResp := resp.RawScan
+		if cmdResp == nil {
+			return nil, nil, errors.Trace(ErrBodyMissing)
+		}
+		for _, pair := range cmdResp.Kvs {
+			keys = append(keys, pair.Key)
+			values = append(values, pair.Value)
+		}
+		if len(loc.StartKey) == 0 {
+			break
+		}
+		endKey = loc.StartKey
+	}
+	return
+}
+
 // DeleteRange deletes all key-value pairs in a range from TiKV
 func (c *RawKVClient) DeleteRange(startKey []byte, endKey []byte) error {
 	start := time.Now()
@@ -220,13 +498,12 @@ func (c *RawKVClient) DeleteRange(startKey []byte, endKey []byte) error {
 
 func (c *RawKVClient) sendReq(key []byte, req *tikvrpc.Request) (*tikvrpc.Response, *KeyLocation, error) {
 	bo := NewBackoffer(context.Background(), rawkvMaxBackoff)
-	sender := NewRegionRequestSender(c.regionCache, c.rpcClient)
 	for {
-		loc, err := c.regionCache.LocateKey(bo, key)
+		loc, err := c.backend.LocateKey(bo, key)
 		if err != nil {
 			return nil, nil, errors.Trace(err)
 		}
-		resp, err := sender.SendReq(bo, req, loc.Region, readTimeoutShort)
+		resp, err := c.backend.SendReq(bo, req, loc.Region, readTimeoutShort)
 		if err != nil {
 			return nil, nil, errors.Trace(err)
 		}
@@ -235,25 +512,79 @@ func (c *RawKVClient) sendReq(key []byte, req *tikvrpc.Request) (*tikvrpc.Respon
 			return nil, nil, errors.Trace(err)
 		}
 		if regionErr != nil {
-			err := bo.Backoff(BoRegionMiss, errors.New(regionErr.String()))
+			err := c.backend.Backoff(bo, BoRegionMiss, errors.New(regionErr.String()))
 			if err != nil {
 				return nil, nil, errors.Trace(err)
 			}
 			continue
 		}
+		if retry, err := c.resolveLockedErr(bo, rawRespErrString(resp)); err != nil {
+			return nil, nil, errors.Trace(err)
+		} else if retry {
+			continue
+		}
 		return resp, loc, nil
 	}
 }
 
+// resolveLockedErr checks whether errStr describes a lock left behind by
+// the transactional API. If it does, it resolves the lock (or backs off if
+// the lock's transaction is still alive) and returns retry=true so the
+// caller re-issues its request; otherwise it returns retry=false and errStr
+// should be treated as an ordinary command error.
+func (c *RawKVClient) resolveLockedErr(bo *Backoffer, errStr string) (retry bool, err error) {
+	lock := parseRawLockedErr(errStr)
+	if lock == nil {
+		return false, nil
+	}
+	callerStartTS, err := c.backend.CurrentTS(bo)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	resolved, err := c.lockResolver.ResolveLocks(bo, callerStartTS, []*Lock{lock})
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if !resolved {
+		if err := c.backend.Backoff(bo, BoTxnLock, errors.New("lock not yet resolved, retrying")); err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+	return true, nil
+}
+
+// rawRespErrString extracts the bare string error from a raw command
+// response, or "" if the response carries no error. Scan responses have no
+// top-level error and are not handled here.
+func rawRespErrString(resp *tikvrpc.Response) string {
+	switch {
+	case resp.RawGet != nil:
+		return resp.RawGet.GetError()
+	case resp.RawPut != nil:
+		return resp.RawPut.GetError()
+	case resp.RawDelete != nil:
+		return resp.RawDelete.GetError()
+	case resp.RawBatchGet != nil:
+		return ""
+	case resp.RawBatchPut != nil:
+		return resp.RawBatchPut.GetError()
+	case resp.RawBatchDelete != nil:
+		return resp.RawBatchDelete.GetError()
+	case resp.RawDeleteRange != nil:
+		return resp.RawDeleteRange.GetError()
+	default:
+		return ""
+	}
+}
+
 // sendDeleteRangeReq sends a raw delete range request and returns the response and the actual endKey.
 // If the given range spans over more than one regions, the actual endKey is the end of the first region.
 // We can't use sendReq directly, because we need to know the end of the region before we send the request
 // TODO: Is there any better way to avoid duplicating code with func `sendReq` ?
 func (c *RawKVClient) sendDeleteRangeReq(startKey []byte, endKey []byte) (*tikvrpc.Response, []byte, error) {
 	bo := NewBackoffer(context.Background(), rawkvMaxBackoff)
-	sender := NewRegionRequestSender(c.regionCache, c.rpcClient)
 	for {
-		loc, err := c.regionCache.LocateKey(bo, startKey)
+		loc, err := c.backend.LocateKey(bo, startKey)
 		if err != nil {
 			return nil, nil, errors.Trace(err)
 		}
@@ -271,7 +602,7 @@ func (c *RawKVClient) sendDeleteRangeReq(startKey []byte, endKey []byte) (*tikvr
 			},
 		}
 
-		resp, err := sender.SendReq(bo, req, loc.Region, readTimeoutShort)
+		resp, err := c.backend.SendReq(bo, req, loc.Region, readTimeoutShort)
 		if err != nil {
 			return nil, nil, errors.Trace(err)
 		}
@@ -280,12 +611,17 @@ func (c *RawKVClient) sendDeleteRangeReq(startKey []byte, endKey []byte) (*tikvr
 			return nil, nil, errors.Trace(err)
 		}
 		if regionErr != nil {
-			err := bo.Backoff(BoRegionMiss, errors.New(regionErr.String()))
+			err := c.backend.Backoff(bo, BoRegionMiss, errors.New(regionErr.String()))
 			if err != nil {
 				return nil, nil, errors.Trace(err)
 			}
 			continue
 		}
+		if retry, err := c.resolveLockedErr(bo, resp.RawDeleteRange.GetError()); err != nil {
+			return nil, nil, errors.Trace(err)
+		} else if retry {
+			continue
+		}
 		return resp, actualEndKey, nil
 	}
 }